@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// handleAgentForward services an "auth-agent-req@openssh.com" request on
+// c's session channel: it opens the matching "auth-agent@openssh.com"
+// channel back to the client and wraps it as an agent.Agent, so commands
+// like /prove can ask the client's agent to sign a challenge.
+func (c *Client) handleAgentForward(req *ssh.Request) {
+	channel, requests, err := c.Conn.OpenChannel("auth-agent@openssh.com", nil)
+	if err != nil {
+		logger.Errorf("Agent forwarding requested but channel open failed: %v", err)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	c.Agent = agent.NewClient(channel)
+	if req.WantReply {
+		req.Reply(true, nil)
+	}
+}
+
+// Prove asks target's forwarded agent to sign a freshly generated nonce
+// with the identity matching target's connection fingerprint, then
+// verifies the signature against that same identity's public key. It's a
+// stronger identity check than the raw connection fingerprint: it proves
+// the party answering right now still holds the private key behind that
+// fingerprint, rather than just having held it at handshake time.
+func Prove(target *Client) error {
+	if target.Agent == nil {
+		return fmt.Errorf("%s has no forwarded agent", target.Name)
+	}
+
+	identities, err := target.Agent.List()
+	if err != nil {
+		return fmt.Errorf("could not list agent identities: %v", err)
+	}
+
+	var pubKey ssh.PublicKey
+	for _, identity := range identities {
+		key, err := ssh.ParsePublicKey(identity.Marshal())
+		if err != nil {
+			continue
+		}
+		if Fingerprint(key) == target.Fingerprint() {
+			pubKey = key
+			break
+		}
+	}
+	if pubKey == nil {
+		return fmt.Errorf("%s's agent does not hold the key matching their fingerprint", target.Name)
+	}
+
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	sig, err := target.Agent.Sign(pubKey, nonce)
+	if err != nil {
+		return fmt.Errorf("agent declined to sign challenge: %v", err)
+	}
+
+	if err := pubKey.Verify(nonce, sig); err != nil {
+		return fmt.Errorf("signature verification failed: %v", err)
+	}
+
+	return nil
+}
+
+// /prove <nick> - verify that <nick>'s forwarded agent still holds the
+// private key matching its fingerprint.
+func cmdProve(s *Server, client *Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /prove <nick>")
+	}
+
+	target := s.ClientByName(args[0])
+	if target == nil {
+		return fmt.Errorf("no such user: %s", args[0])
+	}
+
+	if err := Prove(target); err != nil {
+		return err
+	}
+
+	client.Write(fmt.Sprintf("-> %s proved ownership of their key.", target.Name))
+	return nil
+}
+
+// requireAgentProof is consulted by requireOp before any privileged
+// command runs, when the server is configured to demand it.
+func requireAgentProof(s *Server, client *Client) error {
+	if !s.RequireAgentForAdmin {
+		return nil
+	}
+	return Prove(client)
+}
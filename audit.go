@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// AuditEvent is one line of the audit log: a single join, part, rename,
+// op, deop, ban, unban, kick or failed-auth event.
+type AuditEvent struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"` // join, part, rename, op, deop, ban, unban, kick, auth_failed
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	RemoteAddr  string    `json:"remote_addr,omitempty"`
+	Client      string    `json:"client,omitempty"` // SSH client version string
+	Detail      string    `json:"detail,omitempty"`
+}
+
+// AuditLog writes AuditEvents as one JSON object per line, for operators
+// to feed into external SIEM tooling.
+type AuditLog struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewAuditLog creates an AuditLog writing to w.
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w}
+}
+
+// Log appends event to the log. Marshal/write errors are reported via
+// the package logger rather than returned, since a failing audit sink
+// shouldn't be able to break the chat itself.
+func (a *AuditLog) Log(event AuditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		logger.Errorf("Failed to marshal audit event: %v", err)
+		return
+	}
+	data = append(data, '\n')
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, err := a.w.Write(data); err != nil {
+		logger.Errorf("Failed to write audit event: %v", err)
+	}
+}
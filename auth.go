@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// BanQuery describes the dimensions a ban can be matched against. A zero
+// value field is not considered for matching, so a caller only needs to
+// populate the fields it actually knows about.
+type BanQuery struct {
+	Key    string // public key fingerprint
+	IP     string // remote address, without port
+	Name   string // requested username, matched as a glob
+	Client string // ssh client version string
+}
+
+// authRecord is the on-disk/in-memory representation of a single ban entry.
+type authRecord struct {
+	Query BanQuery   `json:"query"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// authState is the persisted shape of an Auth's data, used for JSON
+// marshalling by FileBackend.
+type authState struct {
+	Admins    []string     `json:"admins"`
+	Allowed   []string     `json:"allowed"`
+	Whitelist bool         `json:"whitelist"`
+	Bans      []authRecord `json:"bans"`
+}
+
+// Backend persists the state behind an Auth. MemoryBackend keeps it only in
+// memory; FileBackend additionally mirrors it to a JSON file on disk.
+type Backend interface {
+	Load() (*authState, error)
+	Save(*authState) error
+}
+
+// MemoryBackend is a no-op Backend: state lives only for the lifetime of
+// the process.
+type MemoryBackend struct{}
+
+func (MemoryBackend) Load() (*authState, error) { return &authState{}, nil }
+func (MemoryBackend) Save(*authState) error     { return nil }
+
+// FileBackend mirrors Auth's state to a JSON file on disk, so that op and
+// ban state survives restarts. Writes are atomic: the new content is
+// written to a temp file in the same directory and renamed over the
+// target, so a crash mid-write can't corrupt the existing file.
+type FileBackend struct {
+	Path string
+}
+
+func (f FileBackend) Load() (*authState, error) {
+	state := &authState{}
+	data, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (f FileBackend) Save(state *authState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Path), ".auth-")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, f.Path)
+}
+
+// Auth holds admin, allowlist and ban state for a Server, backed by a
+// Backend for persistence. It is safe for concurrent use.
+type Auth struct {
+	backend Backend
+	lock    sync.Mutex
+
+	admins    map[string]struct{}
+	allowed   map[string]struct{}
+	whitelist bool
+	bans      []authRecord
+}
+
+// NewAuth creates an Auth backed only by memory. Use NewFileAuth to persist
+// state across restarts.
+func NewAuth() *Auth {
+	return &Auth{
+		backend: MemoryBackend{},
+		admins:  map[string]struct{}{},
+		allowed: map[string]struct{}{},
+	}
+}
+
+// NewFileAuth creates an Auth whose state is persisted as JSON at path,
+// loading any existing state immediately.
+func NewFileAuth(path string) (*Auth, error) {
+	a := NewAuth()
+	a.backend = FileBackend{Path: path}
+	if err := a.Load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Load (re)reads state from the backend, replacing the in-memory copy.
+func (a *Auth) Load() error {
+	state, err := a.backend.Load()
+	if err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.admins = map[string]struct{}{}
+	for _, fp := range state.Admins {
+		a.admins[fp] = struct{}{}
+	}
+	a.allowed = map[string]struct{}{}
+	for _, fp := range state.Allowed {
+		a.allowed[fp] = struct{}{}
+	}
+	a.whitelist = state.Whitelist
+	a.bans = state.Bans
+	return nil
+}
+
+// save persists the current state. Assumes caller holds a.lock.
+func (a *Auth) save() {
+	state := &authState{Whitelist: a.whitelist, Bans: a.bans}
+	for fp := range a.admins {
+		state.Admins = append(state.Admins, fp)
+	}
+	for fp := range a.allowed {
+		state.Allowed = append(state.Allowed, fp)
+	}
+	if err := a.backend.Save(state); err != nil {
+		logger.Errorf("Failed to persist auth state: %v", err)
+	}
+}
+
+// LoadAuthorizedKeys seeds the admin set and allowlist from an
+// authorized_keys-style file: every key listed becomes both an admin and an
+// allowed fingerprint.
+func (a *Auth) LoadAuthorizedKeys(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	rest := data
+	for len(rest) > 0 {
+		var pubKey ssh.PublicKey
+		pubKey, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return fmt.Errorf("failed to parse authorized_keys %s: %v", path, err)
+		}
+		fingerprint := Fingerprint(pubKey)
+		a.admins[fingerprint] = struct{}{}
+		a.allowed[fingerprint] = struct{}{}
+	}
+	a.save()
+	return nil
+}
+
+func (a *Auth) Op(fingerprint string) {
+	a.lock.Lock()
+	a.admins[fingerprint] = struct{}{}
+	a.save()
+	a.lock.Unlock()
+}
+
+func (a *Auth) Deop(fingerprint string) {
+	a.lock.Lock()
+	delete(a.admins, fingerprint)
+	a.save()
+	a.lock.Unlock()
+}
+
+func (a *Auth) IsOp(fingerprint string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, r := a.admins[fingerprint]
+	return r
+}
+
+// SetWhitelist turns the allowlist on or off. While on, only fingerprints
+// added via Allow are permitted to connect.
+func (a *Auth) SetWhitelist(enabled bool) {
+	a.lock.Lock()
+	a.whitelist = enabled
+	a.save()
+	a.lock.Unlock()
+}
+
+func (a *Auth) Allow(fingerprint string) {
+	a.lock.Lock()
+	a.allowed[fingerprint] = struct{}{}
+	a.save()
+	a.lock.Unlock()
+}
+
+// IsAllowed reports whether fingerprint may connect: always true when the
+// allowlist is disabled, otherwise only for fingerprints added via Allow.
+func (a *Auth) IsAllowed(fingerprint string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !a.whitelist {
+		return true
+	}
+	_, r := a.allowed[fingerprint]
+	return r
+}
+
+// Ban records a ban matching query, until the given time (or forever, if
+// until is nil).
+func (a *Auth) Ban(query BanQuery, until *time.Time) {
+	a.lock.Lock()
+	a.bans = append(a.bans, authRecord{Query: query, Until: until})
+	a.save()
+	a.lock.Unlock()
+}
+
+// matches reports whether q, an incoming connection's identity, is
+// caught by r, a stored ban record. A field on r only matches if it was
+// set (non-empty): Client matches as a substring of q.Client, and Name
+// matches q.Name as a glob via filepath.Match.
+func (r BanQuery) matches(q BanQuery) bool {
+	if r.Key != "" && r.Key == q.Key {
+		return true
+	}
+	if r.IP != "" && r.IP == q.IP {
+		return true
+	}
+	if r.Client != "" && strings.Contains(q.Client, r.Client) {
+		return true
+	}
+	if r.Name != "" && q.Name != "" {
+		if ok, _ := filepath.Match(r.Name, q.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// IsBanned checks query against every dimension of every recorded ban:
+// fingerprint, remote IP, username glob and client version. Expired bans
+// are pruned as they're encountered.
+func (a *Auth) IsBanned(query BanQuery) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	live := a.bans[:0]
+	banned := false
+	now := time.Now()
+	for _, rec := range a.bans {
+		if rec.Until != nil && rec.Until.Before(now) {
+			continue // expired, drop it
+		}
+		live = append(live, rec)
+		if rec.Query.matches(query) {
+			banned = true
+		}
+	}
+	if len(live) != len(a.bans) {
+		a.bans = live
+		a.save()
+	}
+	return banned
+}
+
+// Unban removes every recorded ban whose query matches query exactly.
+func (a *Auth) Unban(query BanQuery) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	live := a.bans[:0]
+	for _, rec := range a.bans {
+		if rec.Query == query {
+			continue
+		}
+		live = append(live, rec)
+	}
+	a.bans = live
+	a.save()
+}
@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+func TestBanQueryMatches(t *testing.T) {
+	cases := []struct {
+		name string
+		ban  BanQuery
+		conn BanQuery
+		want bool
+	}{
+		{"key match", BanQuery{Key: "aa:bb"}, BanQuery{Key: "aa:bb"}, true},
+		{"key mismatch", BanQuery{Key: "aa:bb"}, BanQuery{Key: "cc:dd"}, false},
+		{"ip match", BanQuery{IP: "1.2.3.4"}, BanQuery{IP: "1.2.3.4"}, true},
+		{"client substring", BanQuery{Client: "libssh"}, BanQuery{Client: "SSH-2.0-libssh_0.9"}, true},
+		{"client no match", BanQuery{Client: "libssh"}, BanQuery{Client: "SSH-2.0-OpenSSH_8.1"}, false},
+		{"name glob match", BanQuery{Name: "bot-*"}, BanQuery{Name: "bot-42"}, true},
+		{"name glob mismatch", BanQuery{Name: "bot-*"}, BanQuery{Name: "alice"}, false},
+		{"name glob empty query", BanQuery{Name: "bot-*"}, BanQuery{}, false},
+		{"zero ban query matches nothing", BanQuery{}, BanQuery{Key: "aa:bb", IP: "1.2.3.4", Name: "alice", Client: "x"}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.ban.matches(c.conn); got != c.want {
+				t.Errorf("matches(%+v, %+v) = %v, want %v", c.ban, c.conn, got, c.want)
+			}
+		})
+	}
+}
+
+func TestAuthIsBanned(t *testing.T) {
+	a := NewAuth()
+	a.Ban(BanQuery{Key: "fp1"}, nil)
+	a.Ban(BanQuery{Name: "bot-*"}, nil)
+
+	if !a.IsBanned(BanQuery{Key: "fp1"}) {
+		t.Error("expected fp1 to be banned")
+	}
+	if !a.IsBanned(BanQuery{Name: "bot-7"}) {
+		t.Error("expected bot-7 to be banned by name glob")
+	}
+	if a.IsBanned(BanQuery{Key: "fp2", Name: "alice"}) {
+		t.Error("did not expect fp2/alice to be banned")
+	}
+
+	a.Unban(BanQuery{Key: "fp1"})
+	if a.IsBanned(BanQuery{Key: "fp1"}) {
+		t.Error("expected fp1 to be unbanned")
+	}
+}
+
+func TestAuthWhitelist(t *testing.T) {
+	a := NewAuth()
+	if !a.IsAllowed("anyone") {
+		t.Error("expected everyone allowed while whitelist is disabled")
+	}
+
+	a.SetWhitelist(true)
+	if a.IsAllowed("fp1") {
+		t.Error("did not expect fp1 to be allowed before being added")
+	}
+
+	a.Allow("fp1")
+	if !a.IsAllowed("fp1") {
+		t.Error("expected fp1 to be allowed after Allow")
+	}
+	if a.IsAllowed("fp2") {
+		t.Error("did not expect fp2 to be allowed")
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sessionCounter hands out the unique, ever-increasing sessionID each
+// Client is tagged with, so metrics can distinguish two simultaneous
+// connections that happen to share a fingerprint.
+var sessionCounter int64
+
+// Client represents one connected user's session: their chosen name, the
+// underlying SSH connection, and the channel used to queue outgoing
+// messages for them.
+type Client struct {
+	Server    *Server
+	Conn      *ssh.ServerConn
+	Name      string
+	Msg       chan string
+	sessionID string // unique per connection, for per-session metrics
+
+	// Identified is true once the client has claimed a registered nick,
+	// either automatically (its fingerprint matches a registered owner)
+	// or via /identify.
+	Identified bool
+
+	// Room is the client's active room: where unprefixed messages go.
+	// rooms is the full set of rooms they're currently a member of.
+	// Room is only ever touched from this client's own session goroutine.
+	// rooms is too, except that BroadcastToClientRooms also reads it from
+	// a timer goroutine (on MainTimeout/IdleTimeout), so it's guarded by
+	// roomsLock.
+	Room      string
+	roomsLock sync.Mutex
+	rooms     map[string]struct{}
+
+	// Agent is the user's forwarded ssh-agent, if any. Set once the
+	// client sends an auth-agent-req@openssh.com request and we
+	// successfully open the matching auth-agent@openssh.com channel
+	// back to them. Nil otherwise.
+	Agent agent.Agent
+
+	// mainTimeoutTimer and idleTimer back Server.enforceDeadlines's
+	// MainTimeout/IdleTimeout respectively. Server.Remove stops both on a
+	// clean disconnect so a timer that hasn't fired yet doesn't later
+	// broadcast a stale timeout notice. Nil when the corresponding
+	// timeout is disabled.
+	mainTimeoutTimer *time.Timer
+	idleTimer        *time.Timer
+
+	// resetIdleDeadline, when set by Server.enforceDeadlines, pushes
+	// idleTimer back out; called after every successful read or write so
+	// an active client is never dropped for idling. Nil when IdleTimeout
+	// is disabled.
+	resetIdleDeadline func()
+
+	// quit is closed exactly once, by Server.Remove on disconnect. Write
+	// and the writer goroutine in handleSession both select on it alongside
+	// c.Msg, which is never closed, so the writer can exit without racing a Room.Broadcast
+	// that snapshotted this client before the close and is still trying
+	// to send to it.
+	quit chan struct{}
+}
+
+// NewClient creates a Client wrapping an already-authenticated SSH
+// connection. Its Name starts out as whatever username the connection
+// authenticated as; Server.Add will rename it to something unique.
+func NewClient(s *Server, conn *ssh.ServerConn) *Client {
+	return &Client{
+		Server:    s,
+		Conn:      conn,
+		Name:      conn.User(),
+		Msg:       make(chan string, 16),
+		rooms:     map[string]struct{}{},
+		sessionID: fmt.Sprintf("%d", atomic.AddInt64(&sessionCounter, 1)),
+		quit:      make(chan struct{}),
+	}
+}
+
+// InRoom reports whether the client is currently a member of the named
+// room.
+func (c *Client) InRoom(name string) bool {
+	c.roomsLock.Lock()
+	defer c.roomsLock.Unlock()
+	_, ok := c.rooms[name]
+	return ok
+}
+
+// RoomNames returns a snapshot of the rooms the client is currently a
+// member of.
+func (c *Client) RoomNames() []string {
+	c.roomsLock.Lock()
+	defer c.roomsLock.Unlock()
+	names := make([]string, 0, len(c.rooms))
+	for name := range c.rooms {
+		names = append(names, name)
+	}
+	return names
+}
+
+// clearRooms empties the client's room membership. Server.Remove calls
+// this once on disconnect, so a MainTimeout/IdleTimeout timer that races
+// with a clean quit finds nothing left to broadcast to.
+func (c *Client) clearRooms() {
+	c.roomsLock.Lock()
+	c.rooms = map[string]struct{}{}
+	c.Room = ""
+	c.roomsLock.Unlock()
+}
+
+func (c *Client) Fingerprint() string {
+	return c.Conn.Permissions.Extensions["fingerprint"]
+}
+
+func (c *Client) Rename(name string) {
+	c.Name = name
+}
+
+func (c *Client) WriteLines(lines []string) {
+	for _, line := range lines {
+		c.Write(line)
+	}
+}
+
+// Write queues msg for delivery to the client. It's a no-op once the
+// client has disconnected (c.quit closed), so callers racing Server.Remove
+// drop the message instead of blocking on a writer goroutine that's gone.
+func (c *Client) Write(msg string) {
+	select {
+	case c.Msg <- msg:
+	case <-c.quit:
+	}
+}
+
+// handleChannels services every channel opened on this client's
+// connection. Only "session" channels are handled here directly;
+// "direct-tcpip" channels are intercepted upstream by
+// Server.filterDirectTCPIP before ever reaching this loop.
+func (c *Client) handleChannels(channels <-chan ssh.NewChannel) {
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			logger.Errorf("Failed to accept channel: %v", err)
+			continue
+		}
+
+		go c.handleSession(channel, requests)
+	}
+}
+
+// handleSession services requests and data on a single "session" channel:
+// pty/shell negotiation, agent-forwarding setup, and the line-oriented
+// chat protocol itself.
+func (c *Client) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	// Add runs here, before the request/message/input goroutines below
+	// start, so the client's room membership is fully set up before
+	// anything else can touch it.
+	c.Server.Add(c)
+
+	go func() {
+		for req := range requests {
+			switch req.Type {
+			case "shell", "pty-req", "window-change":
+				if req.WantReply {
+					req.Reply(true, nil)
+				}
+			case "auth-agent-req@openssh.com":
+				c.handleAgentForward(req)
+			default:
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+			}
+		}
+	}()
+
+	go func() {
+		defer channel.Close()
+		for {
+			select {
+			case msg := <-c.Msg:
+				n, _ := fmt.Fprintf(channel, "%s\r\n", msg)
+				c.Server.metrics.BytesOut(c.sessionID, n)
+				if c.resetIdleDeadline != nil {
+					c.resetIdleDeadline()
+				}
+			case <-c.quit:
+				return
+			}
+		}
+	}()
+
+	scanner := bufio.NewScanner(channel)
+	for scanner.Scan() {
+		c.Server.metrics.BytesIn(c.sessionID, len(scanner.Bytes()))
+		if c.resetIdleDeadline != nil {
+			c.resetIdleDeadline()
+		}
+		line := strings.TrimRight(scanner.Text(), "\r\n")
+		if line == "" {
+			continue
+		}
+		c.handleLine(line)
+	}
+
+	c.Server.Remove(c)
+}
+
+// handleLine dispatches a single line of input from the client: a
+// "/command args" to the command table, a "#room: msg" addressed to a
+// specific room, or a plain message to the client's active room.
+func (c *Client) handleLine(line string) {
+	if strings.HasPrefix(line, "/") {
+		fields := strings.Fields(line)
+		name, args := fields[0], fields[1:]
+
+		handler, ok := commandTable[name]
+		if !ok {
+			c.Write(fmt.Sprintf("-> Unknown command: %s", name))
+			return
+		}
+		if err := handler(c.Server, c, args); err != nil {
+			c.Write(fmt.Sprintf("-> %s", err))
+		}
+		return
+	}
+
+	roomName, msg := c.Room, line
+	if strings.HasPrefix(line, "#") {
+		if idx := strings.Index(line, ":"); idx > 0 {
+			roomName = line[:idx]
+			msg = strings.TrimSpace(line[idx+1:])
+		}
+	}
+
+	room := c.Server.room(roomName)
+	if room == nil || !c.InRoom(roomName) {
+		c.Write(fmt.Sprintf("-> Not in room: %s", roomName))
+		return
+	}
+	if room.IsModerated() && !room.IsOp(c) && !c.Server.IsOp(c) {
+		c.Write(fmt.Sprintf("-> %s is moderated: only ops may speak.", roomName))
+		return
+	}
+	room.Broadcast(fmt.Sprintf("%s: %s", displayName(c), msg), nil)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// commandHandler implements a single chat command. args excludes the
+// command name itself.
+type commandHandler func(s *Server, client *Client, args []string) error
+
+// coreCommands are basic chat commands not owned by any particular
+// subsystem, merged into the main command table by the command parser.
+var coreCommands = map[string]commandHandler{
+	"/nick": cmdNick,
+}
+
+// authCommands are the chat commands exposed by the Auth subsystem. They're
+// merged into the main command table by the command parser.
+var authCommands = map[string]commandHandler{
+	"/allow":       cmdAllow,
+	"/whitelist":   cmdWhitelist,
+	"/ban":         cmdBan,
+	"/banip":       cmdBanIP,
+	"/banclient":   cmdBanClient,
+	"/banname":     cmdBanName,
+	"/unban":       cmdUnban,
+	"/unbanip":     cmdUnbanIP,
+	"/unbanclient": cmdUnbanClient,
+	"/unbanname":   cmdUnbanName,
+	"/op":          cmdOp,
+	"/deop":        cmdDeop,
+	"/prove":       cmdProve,
+	"/kick":        cmdKick,
+}
+
+// commandTable is the full set of chat commands dispatched by
+// Client.handleLine, merged from every subsystem's command map.
+var commandTable = mergeCommands(coreCommands, authCommands, nickservCommands, roomCommands)
+
+func mergeCommands(maps ...map[string]commandHandler) map[string]commandHandler {
+	merged := map[string]commandHandler{}
+	for _, m := range maps {
+		for name, handler := range m {
+			merged[name] = handler
+		}
+	}
+	return merged
+}
+
+// requireOp checks that client is an operator, and, when the server
+// requires it, that they've just proven they still hold the private key
+// behind their fingerprint via their forwarded agent. Every privileged
+// command in authCommands (/ban and its variants, /unban and its
+// variants, /op, /deop, /kick, /allow, /whitelist) is gated through
+// this, so RequireAgentForAdmin covers all of them; the room-scoped
+// /room-op promotion command is a separate, unrelated handler gated by
+// requireRoomOp instead.
+func requireOp(s *Server, client *Client) error {
+	if !s.IsOp(client) {
+		return fmt.Errorf("must be an operator to do that")
+	}
+	return requireAgentProof(s, client)
+}
+
+// /nick <name> - change the caller's display name.
+func cmdNick(s *Server, client *Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /nick <name>")
+	}
+	s.Rename(client, args[0])
+	return nil
+}
+
+// /allow <fingerprint> - add a fingerprint to the allowlist.
+func cmdAllow(s *Server, client *Client, args []string) error {
+	if err := requireOp(s, client); err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /allow <fingerprint>")
+	}
+	s.Allow(args[0])
+	client.Write(fmt.Sprintf("-> Allowed: %s", args[0]))
+	return nil
+}
+
+// /whitelist <on|off> - toggle allowlist enforcement.
+func cmdWhitelist(s *Server, client *Client, args []string) error {
+	if err := requireOp(s, client); err != nil {
+		return err
+	}
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		return fmt.Errorf("usage: /whitelist <on|off>")
+	}
+	s.Whitelist(args[0] == "on")
+	client.Write(fmt.Sprintf("-> Whitelist: %s", args[0]))
+	return nil
+}
+
+// /banip <addr> [duration] - ban every connection from a remote IP.
+func cmdBanIP(s *Server, client *Client, args []string) error {
+	if err := requireOp(s, client); err != nil {
+		return err
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: /banip <addr> [duration]")
+	}
+	duration, err := parseBanDuration(args)
+	if err != nil {
+		return err
+	}
+	s.BanIP(args[0], duration)
+	client.Write(fmt.Sprintf("-> Banned IP: %s", args[0]))
+	return nil
+}
+
+// /banclient <substr> [duration] - ban every connection whose SSH client
+// version string contains substr.
+func cmdBanClient(s *Server, client *Client, args []string) error {
+	if err := requireOp(s, client); err != nil {
+		return err
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: /banclient <substr> [duration]")
+	}
+	duration, err := parseBanDuration(args)
+	if err != nil {
+		return err
+	}
+	s.BanClient(args[0], duration)
+	client.Write(fmt.Sprintf("-> Banned client: %s", args[0]))
+	return nil
+}
+
+// /banname <glob> [duration] - ban every connection whose requested
+// username matches glob.
+func cmdBanName(s *Server, client *Client, args []string) error {
+	if err := requireOp(s, client); err != nil {
+		return err
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: /banname <glob> [duration]")
+	}
+	duration, err := parseBanDuration(args)
+	if err != nil {
+		return err
+	}
+	s.BanName(args[0], duration)
+	client.Write(fmt.Sprintf("-> Banned name: %s", args[0]))
+	return nil
+}
+
+// /ban <nick> [duration] - ban the fingerprint behind a connected user.
+func cmdBan(s *Server, client *Client, args []string) error {
+	if err := requireOp(s, client); err != nil {
+		return err
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: /ban <nick> [duration]")
+	}
+	target := s.ClientByName(args[0])
+	if target == nil {
+		return fmt.Errorf("no such user: %s", args[0])
+	}
+	duration, err := parseBanDuration(args)
+	if err != nil {
+		return err
+	}
+	s.Ban(target.Fingerprint(), duration)
+	client.Write(fmt.Sprintf("-> Banned: %s", target.Name))
+	return nil
+}
+
+// /unban <nick> - lift a ban previously issued with /ban against nick's
+// fingerprint. nick must currently be connected, since a fingerprint ban
+// has no other chat-reachable handle once the user has left.
+func cmdUnban(s *Server, client *Client, args []string) error {
+	if err := requireOp(s, client); err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /unban <nick>")
+	}
+	target := s.ClientByName(args[0])
+	if target == nil {
+		return fmt.Errorf("no such user: %s", args[0])
+	}
+	s.Unban(target.Fingerprint())
+	client.Write(fmt.Sprintf("-> Unbanned: %s", target.Name))
+	return nil
+}
+
+// /unbanip <addr> - lift a ban previously issued with /banip.
+func cmdUnbanIP(s *Server, client *Client, args []string) error {
+	if err := requireOp(s, client); err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /unbanip <addr>")
+	}
+	s.UnbanIP(args[0])
+	client.Write(fmt.Sprintf("-> Unbanned IP: %s", args[0]))
+	return nil
+}
+
+// /unbanclient <substr> - lift a ban previously issued with /banclient.
+func cmdUnbanClient(s *Server, client *Client, args []string) error {
+	if err := requireOp(s, client); err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /unbanclient <substr>")
+	}
+	s.UnbanClient(args[0])
+	client.Write(fmt.Sprintf("-> Unbanned client: %s", args[0]))
+	return nil
+}
+
+// /unbanname <glob> - lift a ban previously issued with /banname.
+func cmdUnbanName(s *Server, client *Client, args []string) error {
+	if err := requireOp(s, client); err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /unbanname <glob>")
+	}
+	s.UnbanName(args[0])
+	client.Write(fmt.Sprintf("-> Unbanned name: %s", args[0]))
+	return nil
+}
+
+// /op <fingerprint> - grant a fingerprint server-wide admin status.
+func cmdOp(s *Server, client *Client, args []string) error {
+	if err := requireOp(s, client); err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /op <fingerprint>")
+	}
+	s.Op(args[0])
+	client.Write(fmt.Sprintf("-> Opped: %s", args[0]))
+	return nil
+}
+
+// /deop <fingerprint> - remove a fingerprint's admin status.
+func cmdDeop(s *Server, client *Client, args []string) error {
+	if err := requireOp(s, client); err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /deop <fingerprint>")
+	}
+	s.Deop(args[0])
+	client.Write(fmt.Sprintf("-> Deopped: %s", args[0]))
+	return nil
+}
+
+// /kick <nick> - disconnect a user outright.
+func cmdKick(s *Server, client *Client, args []string) error {
+	if err := requireOp(s, client); err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /kick <nick>")
+	}
+	target := s.ClientByName(args[0])
+	if target == nil {
+		return fmt.Errorf("no such user: %s", args[0])
+	}
+	if target == client {
+		return fmt.Errorf("can't kick yourself")
+	}
+
+	s.auditLog(AuditEvent{Type: "kick", Fingerprint: target.Fingerprint(), RemoteAddr: hostOnly(target.Conn.RemoteAddr().String()), Client: string(target.Conn.ClientVersion()), Detail: fmt.Sprintf("kicked by %s", client.Name)})
+	target.Conn.Close()
+	client.Write(fmt.Sprintf("-> Kicked %s.", target.Name))
+	return nil
+}
+
+// parseBanDuration parses the optional second ban argument as a
+// time.Duration, returning nil (ban forever) when it's absent.
+func parseBanDuration(args []string) (*time.Duration, error) {
+	if len(args) < 2 {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(args[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid duration: %s", args[1])
+	}
+	return &d, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// roomCommands are the chat commands exposed by the room subsystem,
+// merged into the main command table by the command parser.
+var roomCommands = map[string]commandHandler{
+	"/join":       cmdJoin,
+	"/part":       cmdPart,
+	"/list-rooms": cmdListRooms,
+	"/topic":      cmdTopic,
+	"/invite":     cmdInvite,
+	"/room-op":    cmdRoomOp,
+	"/mode":       cmdMode,
+}
+
+// requireRoomOp checks that client is an op of room: either a
+// room-scoped op, or a server-wide admin.
+func requireRoomOp(s *Server, client *Client, room *Room) error {
+	if !room.IsOp(client) && !s.IsOp(client) {
+		return fmt.Errorf("must be an operator of %s to do that", room.Name())
+	}
+	return requireAgentProof(s, client)
+}
+
+// /join #name - join (creating if necessary) a room, making it active.
+func cmdJoin(s *Server, client *Client, args []string) error {
+	if len(args) != 1 || !strings.HasPrefix(args[0], "#") {
+		return fmt.Errorf("usage: /join #room")
+	}
+	if err := s.JoinRoom(client, args[0]); err != nil {
+		return err
+	}
+	client.Write(fmt.Sprintf("-> Joined %s.", args[0]))
+	return nil
+}
+
+// /part [#name] - leave a room, defaulting to the active one.
+func cmdPart(s *Server, client *Client, args []string) error {
+	name := client.Room
+	if len(args) == 1 {
+		name = args[0]
+	} else if len(args) > 1 {
+		return fmt.Errorf("usage: /part [#room]")
+	}
+	if err := s.PartRoom(client, name); err != nil {
+		return err
+	}
+	client.Write(fmt.Sprintf("-> Left %s.", name))
+	return nil
+}
+
+// /list-rooms - list every room the caller can see.
+func cmdListRooms(s *Server, client *Client, args []string) error {
+	rooms := s.ListRooms(client)
+	client.Write(fmt.Sprintf("-> Rooms: %s", strings.Join(rooms, ", ")))
+	return nil
+}
+
+// /topic [text] - show, or (if an op) set, the active room's topic.
+func cmdTopic(s *Server, client *Client, args []string) error {
+	room := s.room(client.Room)
+	if room == nil {
+		return fmt.Errorf("not in a room")
+	}
+	if len(args) == 0 {
+		client.Write(fmt.Sprintf("-> Topic for %s: %s", room.Name(), room.Topic()))
+		return nil
+	}
+	if err := requireRoomOp(s, client, room); err != nil {
+		return err
+	}
+	room.SetTopic(strings.Join(args, " "))
+	room.Broadcast(fmt.Sprintf("* %s set the topic: %s", displayName(client), room.Topic()), nil)
+	return nil
+}
+
+// /invite <nick> - invite nick into the active room, bypassing
+// invite-only. Requires being a room (or server) op.
+func cmdInvite(s *Server, client *Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /invite <nick>")
+	}
+	room := s.room(client.Room)
+	if room == nil {
+		return fmt.Errorf("not in a room")
+	}
+	if err := requireRoomOp(s, client, room); err != nil {
+		return err
+	}
+
+	target := s.ClientByName(args[0])
+	if target == nil {
+		return fmt.Errorf("no such user: %s", args[0])
+	}
+	room.Invite(target.Fingerprint())
+	target.Write(fmt.Sprintf("-> %s invited you to %s.", displayName(client), room.Name()))
+	client.Write(fmt.Sprintf("-> Invited %s to %s.", target.Name, room.Name()))
+	return nil
+}
+
+// /room-op <nick> - make nick an op of the active room.
+func cmdRoomOp(s *Server, client *Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /room-op <nick>")
+	}
+	room := s.room(client.Room)
+	if room == nil {
+		return fmt.Errorf("not in a room")
+	}
+	if err := requireRoomOp(s, client, room); err != nil {
+		return err
+	}
+
+	target := s.ClientByName(args[0])
+	if target == nil {
+		return fmt.Errorf("no such user: %s", args[0])
+	}
+	room.Op(target.Fingerprint())
+	room.Broadcast(fmt.Sprintf("* %s is now an op of %s.", displayName(target), room.Name()), nil)
+	return nil
+}
+
+// /mode #room <invite-only|moderated|private> <on|off> - toggle one of a
+// room's mode flags. Requires being an op of the room.
+func cmdMode(s *Server, client *Client, args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("usage: /mode #room <invite-only|moderated|private> <on|off>")
+	}
+	if args[2] != "on" && args[2] != "off" {
+		return fmt.Errorf("usage: /mode #room <invite-only|moderated|private> <on|off>")
+	}
+
+	room := s.room(args[0])
+	if room == nil {
+		return fmt.Errorf("no such room: %s", args[0])
+	}
+	if err := requireRoomOp(s, client, room); err != nil {
+		return err
+	}
+
+	enabled := args[2] == "on"
+	if err := room.SetMode(args[1], enabled); err != nil {
+		return err
+	}
+
+	room.Broadcast(fmt.Sprintf("* %s set %s %s for %s.", displayName(client), args[1], args[2], room.Name()), nil)
+	return nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ForwardingPolicy controls which non-shell SSH requests a Server will
+// honour, and how long it will keep an idle connection open. The zero
+// value allows no forwarding and applies no timeouts.
+type ForwardingPolicy struct {
+	AllowDirectTCPIP    bool
+	AllowTCPIPForward   bool
+	AllowedForwardPorts []int // empty means any port is allowed, if forwarding is on
+
+	MainTimeout   time.Duration // hard cap on total connection lifetime, 0 disables
+	IdleTimeout   time.Duration // dropped if nothing is read/written for this long, 0 disables
+	DirectTimeout time.Duration // deadline applied to dialed direct-tcpip connections, 0 disables
+}
+
+// directTCPIPPayload is the RFC 4254 ssh.Unmarshal shape of a
+// "direct-tcpip" channel-open request.
+type directTCPIPPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// tcpIPForwardPayload is the RFC 4254 ssh.Unmarshal shape of a
+// "tcpip-forward" global request.
+type tcpIPForwardPayload struct {
+	Addr string
+	Port uint32
+}
+
+func (s *Server) portAllowed(port uint32) bool {
+	if len(s.policy.AllowedForwardPorts) == 0 {
+		return true
+	}
+	for _, p := range s.policy.AllowedForwardPorts {
+		if uint32(p) == port {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardCounts tracks how many forwarded connections are currently open
+// per fingerprint, so abusive clients can be rate-limited or banned.
+type forwardCounts struct {
+	lock       sync.Mutex
+	counts     map[string]int
+	violations map[string]int
+}
+
+var forwardLimiter = forwardCounts{counts: map[string]int{}, violations: map[string]int{}}
+
+func (f *forwardCounts) incr(fingerprint string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.counts[fingerprint]++
+	return f.counts[fingerprint]
+}
+
+func (f *forwardCounts) decr(fingerprint string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.counts[fingerprint]--
+	if f.counts[fingerprint] <= 0 {
+		delete(f.counts, fingerprint)
+	}
+}
+
+// violation records fingerprint hitting the forward-rate limit and
+// reports how many times it's happened. Counts are never reset for the
+// life of the process: a client that keeps bumping the limit should keep
+// climbing toward a ban, not get a clean slate on its next connection.
+func (f *forwardCounts) violation(fingerprint string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.violations[fingerprint]++
+	return f.violations[fingerprint]
+}
+
+const (
+	maxForwardsPerClient = 10
+
+	// maxForwardViolations is the rate-limit hit on which a fingerprint is
+	// banned outright rather than merely rejected: the earlier hits are
+	// only rejected.
+	maxForwardViolations = 3
+
+	// forwardAbuseBanDuration is how long a fingerprint is banned for
+	// once it crosses maxForwardViolations.
+	forwardAbuseBanDuration = 10 * time.Minute
+)
+
+// handleDirectTCPIP services a "direct-tcpip" channel-open request: dials
+// the requested address on behalf of the client and pipes bytes between
+// the SSH channel and the TCP connection. Ports outside
+// AllowedForwardPorts, or forwarding disabled entirely, are rejected.
+func (s *Server) handleDirectTCPIP(newChannel ssh.NewChannel, fingerprint string) {
+	var payload directTCPIPPayload
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "malformed direct-tcpip request")
+		return
+	}
+
+	if !s.policy.AllowDirectTCPIP {
+		newChannel.Reject(ssh.Prohibited, "direct-tcpip forwarding disabled")
+		return
+	}
+	if !s.portAllowed(payload.Port) {
+		newChannel.Reject(ssh.Prohibited, "port not allowed")
+		return
+	}
+	if forwardLimiter.incr(fingerprint) > maxForwardsPerClient {
+		forwardLimiter.decr(fingerprint)
+		newChannel.Reject(ssh.Prohibited, "too many forwarded connections")
+		if forwardLimiter.violation(fingerprint) >= maxForwardViolations {
+			logger.Infof("Banning %s for repeated forward-limit abuse", fingerprint)
+			duration := forwardAbuseBanDuration
+			s.Ban(fingerprint, &duration)
+		} else {
+			logger.Infof("Rate-limiting forwards from %s", fingerprint)
+		}
+		return
+	}
+	defer forwardLimiter.decr(fingerprint)
+
+	target := fmt.Sprintf("%s:%d", payload.Addr, payload.Port)
+	conn, err := net.DialTimeout("tcp", target, s.policy.DirectTimeout)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "dial failed")
+		return
+	}
+	defer conn.Close()
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+
+	if s.policy.DirectTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.policy.DirectTimeout))
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(conn, channel)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(channel, conn)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// handleGlobalRequests replaces a blind ssh.DiscardRequests loop: it
+// inspects every global request arriving outside of a channel
+// ("tcpip-forward", "cancel-tcpip-forward") and rejects anything not
+// permitted by the server's ForwardingPolicy, instead of silently
+// discarding (and implicitly allowing) it.
+func (s *Server) handleGlobalRequests(requests <-chan *ssh.Request) {
+	for req := range requests {
+		switch req.Type {
+		case "tcpip-forward":
+			s.handleTCPIPForward(req)
+		case "cancel-tcpip-forward":
+			if req.WantReply {
+				req.Reply(true, nil)
+			}
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func (s *Server) handleTCPIPForward(req *ssh.Request) {
+	var payload tcpIPForwardPayload
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	if !s.policy.AllowTCPIPForward || !s.portAllowed(payload.Port) {
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+		return
+	}
+
+	// Remote forwarding (listening on the server's behalf) is not
+	// implemented. Reply false rather than claiming success: a client
+	// told true would sit waiting for connections that can never arrive.
+	if req.WantReply {
+		req.Reply(false, nil)
+	}
+}
+
+// filterDirectTCPIP intercepts "direct-tcpip" channel-open requests and
+// services them itself (subject to ForwardingPolicy), passing every other
+// channel type through untouched for the normal session handler.
+func (s *Server) filterDirectTCPIP(channels <-chan ssh.NewChannel, fingerprint string) <-chan ssh.NewChannel {
+	out := make(chan ssh.NewChannel)
+	go func() {
+		defer close(out)
+		for newChannel := range channels {
+			if newChannel.ChannelType() == "direct-tcpip" {
+				go s.handleDirectTCPIP(newChannel, fingerprint)
+				continue
+			}
+			out <- newChannel
+		}
+	}()
+	return out
+}
+
+// enforceDeadlines applies the configured idle/main timeouts to conn,
+// dropping the connection (with a distinguishing broadcast notice) once
+// they're exceeded. Both timers are stopped by Server.Remove on a clean
+// disconnect, so they're harmless if conn is already closed by the time
+// they'd otherwise fire.
+func (s *Server) enforceDeadlines(conn net.Conn, client *Client) {
+	if s.policy.MainTimeout > 0 {
+		client.mainTimeoutTimer = time.AfterFunc(s.policy.MainTimeout, func() {
+			s.BroadcastToClientRooms(client, fmt.Sprintf("* %s timed out (max session length).", displayName(client)))
+			conn.Close()
+		})
+	}
+
+	if s.policy.IdleTimeout > 0 {
+		client.idleTimer = time.AfterFunc(s.policy.IdleTimeout, func() {
+			s.BroadcastToClientRooms(client, fmt.Sprintf("* %s timed out (idle).", displayName(client)))
+			conn.Close()
+		})
+		client.resetIdleDeadline = func() {
+			client.idleTimer.Reset(s.policy.IdleTimeout)
+		}
+	}
+}
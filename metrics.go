@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics tracks server-wide counters and gauges, and can serve them in
+// Prometheus's text exposition format over HTTP.
+type Metrics struct {
+	connectionsAccepted int64
+	handshakeFailures   int64
+	bansIssued          int64
+	bansHit             int64
+	messagesBroadcast   int64
+
+	lock                sync.Mutex
+	activeClients       int64
+	bytesIn             map[string]int64  // fingerprint -> cumulative bytes read, across every session
+	bytesOut            map[string]int64  // fingerprint -> cumulative bytes written, across every session
+	fingerprintOf       map[string]string // session id -> fingerprint, for crediting BytesIn/BytesOut while the session is live
+	sessionStart        map[string]time.Time
+	lastSessionDuration map[string]time.Duration // fingerprint -> duration of their most recently completed session
+}
+
+// NewMetrics creates an empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		bytesIn:             map[string]int64{},
+		bytesOut:            map[string]int64{},
+		fingerprintOf:       map[string]string{},
+		sessionStart:        map[string]time.Time{},
+		lastSessionDuration: map[string]time.Duration{},
+	}
+}
+
+func (m *Metrics) ConnectionAccepted() { atomic.AddInt64(&m.connectionsAccepted, 1) }
+func (m *Metrics) HandshakeFailed()    { atomic.AddInt64(&m.handshakeFailures, 1) }
+func (m *Metrics) BanIssued()          { atomic.AddInt64(&m.bansIssued, 1) }
+func (m *Metrics) BanHit()             { atomic.AddInt64(&m.bansHit, 1) }
+func (m *Metrics) MessageBroadcast()   { atomic.AddInt64(&m.messagesBroadcast, 1) }
+
+// ClientJoined marks the start of a session, keyed by the connection's
+// own unique sessionID rather than fingerprint, so two simultaneous
+// connections authenticated with the same key don't clobber each
+// other's accounting.
+func (m *Metrics) ClientJoined(sessionID, fingerprint string) {
+	atomic.AddInt64(&m.activeClients, 1)
+	m.lock.Lock()
+	m.sessionStart[sessionID] = time.Now()
+	m.fingerprintOf[sessionID] = fingerprint
+	m.lock.Unlock()
+}
+
+// ClientLeft records the completed session duration for sessionID. The
+// fingerprint's cumulative bytesIn/bytesOut are left untouched: they're
+// totals across every session that fingerprint has ever had, not a
+// per-session gauge, so they must keep counting up after the client
+// disconnects rather than resetting to zero.
+func (m *Metrics) ClientLeft(sessionID string) time.Duration {
+	atomic.AddInt64(&m.activeClients, -1)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	start, ok := m.sessionStart[sessionID]
+	fingerprint := m.fingerprintOf[sessionID]
+	delete(m.sessionStart, sessionID)
+	delete(m.fingerprintOf, sessionID)
+	if !ok {
+		return 0
+	}
+	duration := time.Since(start)
+	m.lastSessionDuration[fingerprint] = duration
+	return duration
+}
+
+func (m *Metrics) BytesIn(sessionID string, n int) {
+	m.lock.Lock()
+	m.bytesIn[m.fingerprintOf[sessionID]] += int64(n)
+	m.lock.Unlock()
+}
+
+func (m *Metrics) BytesOut(sessionID string, n int) {
+	m.lock.Lock()
+	m.bytesOut[m.fingerprintOf[sessionID]] += int64(n)
+	m.lock.Unlock()
+}
+
+// WriteTo writes every counter and gauge in Prometheus text exposition
+// format.
+func (m *Metrics) WriteTo(w http.ResponseWriter) {
+	fmt.Fprintf(w, "# HELP sshchat_connections_accepted_total Connections accepted.\n")
+	fmt.Fprintf(w, "# TYPE sshchat_connections_accepted_total counter\n")
+	fmt.Fprintf(w, "sshchat_connections_accepted_total %d\n", atomic.LoadInt64(&m.connectionsAccepted))
+
+	fmt.Fprintf(w, "# HELP sshchat_handshake_failures_total SSH handshake failures.\n")
+	fmt.Fprintf(w, "# TYPE sshchat_handshake_failures_total counter\n")
+	fmt.Fprintf(w, "sshchat_handshake_failures_total %d\n", atomic.LoadInt64(&m.handshakeFailures))
+
+	fmt.Fprintf(w, "# HELP sshchat_active_clients Currently connected clients.\n")
+	fmt.Fprintf(w, "# TYPE sshchat_active_clients gauge\n")
+	fmt.Fprintf(w, "sshchat_active_clients %d\n", atomic.LoadInt64(&m.activeClients))
+
+	fmt.Fprintf(w, "# HELP sshchat_bans_issued_total Bans issued by operators.\n")
+	fmt.Fprintf(w, "# TYPE sshchat_bans_issued_total counter\n")
+	fmt.Fprintf(w, "sshchat_bans_issued_total %d\n", atomic.LoadInt64(&m.bansIssued))
+
+	fmt.Fprintf(w, "# HELP sshchat_bans_hit_total Connections rejected due to an existing ban.\n")
+	fmt.Fprintf(w, "# TYPE sshchat_bans_hit_total counter\n")
+	fmt.Fprintf(w, "sshchat_bans_hit_total %d\n", atomic.LoadInt64(&m.bansHit))
+
+	fmt.Fprintf(w, "# HELP sshchat_messages_broadcast_total Chat messages broadcast.\n")
+	fmt.Fprintf(w, "# TYPE sshchat_messages_broadcast_total counter\n")
+	fmt.Fprintf(w, "sshchat_messages_broadcast_total %d\n", atomic.LoadInt64(&m.messagesBroadcast))
+
+	m.lock.Lock()
+	// bytesIn/bytesOut are already keyed by fingerprint, and accumulate
+	// across every session a fingerprint has ever had (not just the live
+	// ones), so two simultaneous connections sharing a fingerprint still
+	// collapse to one exposition line each instead of repeating the
+	// fingerprint label set, which scrapers would reject as invalid.
+	fingerprints := make([]string, 0, len(m.bytesIn))
+	for fp := range m.bytesIn {
+		fingerprints = append(fingerprints, fp)
+	}
+	for fp := range m.bytesOut {
+		if _, ok := m.bytesIn[fp]; !ok {
+			fingerprints = append(fingerprints, fp)
+		}
+	}
+	sort.Strings(fingerprints)
+
+	fmt.Fprintf(w, "# HELP sshchat_client_bytes_in_total Cumulative bytes read per client, across every session.\n")
+	fmt.Fprintf(w, "# TYPE sshchat_client_bytes_in_total counter\n")
+	for _, fp := range fingerprints {
+		fmt.Fprintf(w, "sshchat_client_bytes_in_total{fingerprint=%q} %d\n", fp, m.bytesIn[fp])
+	}
+
+	fmt.Fprintf(w, "# HELP sshchat_client_bytes_out_total Cumulative bytes written per client, across every session.\n")
+	fmt.Fprintf(w, "# TYPE sshchat_client_bytes_out_total counter\n")
+	for _, fp := range fingerprints {
+		fmt.Fprintf(w, "sshchat_client_bytes_out_total{fingerprint=%q} %d\n", fp, m.bytesOut[fp])
+	}
+
+	durationFingerprints := make([]string, 0, len(m.lastSessionDuration))
+	for fp := range m.lastSessionDuration {
+		durationFingerprints = append(durationFingerprints, fp)
+	}
+	sort.Strings(durationFingerprints)
+
+	fmt.Fprintf(w, "# HELP sshchat_last_session_duration_seconds Duration of each client's most recently completed session.\n")
+	fmt.Fprintf(w, "# TYPE sshchat_last_session_duration_seconds gauge\n")
+	for _, fp := range durationFingerprints {
+		fmt.Fprintf(w, "sshchat_last_session_duration_seconds{fingerprint=%q} %f\n", fp, m.lastSessionDuration[fp].Seconds())
+	}
+	m.lock.Unlock()
+}
+
+// ServeMetrics starts an HTTP listener at laddr exposing Metrics at
+// /metrics in Prometheus text exposition format.
+func (s *Server) ServeMetrics(laddr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		s.metrics.WriteTo(w)
+	})
+
+	listener, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Serving metrics on %s", laddr)
+	go http.Serve(listener, mux)
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// GuestPrefix marks broadcast names for clients who haven't identified to
+// a registered nick, so registered users are easy to pick out at a
+// glance.
+const GuestPrefix = "~"
+
+// nickRecord is the persisted shape of a single registered nickname.
+type nickRecord struct {
+	Fingerprints []string `json:"fingerprints"`
+}
+
+// NickServ is a persistent registry binding nicknames to one or more
+// fingerprints, so a registered name is reserved across sessions and can
+// only be claimed by one of its owning keys. State is stored as JSON on
+// disk with atomic writes, and can be reloaded on SIGHUP via Load.
+type NickServ struct {
+	path  string
+	lock  sync.Mutex
+	nicks map[string]*nickRecord
+}
+
+// NewNickServ creates a NickServ persisted at path, loading any existing
+// registrations immediately. An empty path keeps the registry in memory
+// only, for servers that don't want registrations to survive a restart.
+func NewNickServ(path string) (*NickServ, error) {
+	n := &NickServ{path: path, nicks: map[string]*nickRecord{}}
+	if err := n.Load(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Load (re)reads the registry from disk, replacing the in-memory copy.
+// Intended to be wired up to SIGHUP so an operator can hand-edit the file.
+func (n *NickServ) Load() error {
+	if n.path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(n.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	nicks := map[string]*nickRecord{}
+	if err := json.Unmarshal(data, &nicks); err != nil {
+		return err
+	}
+
+	n.lock.Lock()
+	n.nicks = nicks
+	n.lock.Unlock()
+	return nil
+}
+
+// save persists the registry atomically: write to a temp file in the
+// same directory, then rename over the target.
+func (n *NickServ) save() error {
+	if n.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(n.nicks, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(n.path), ".nickserv-")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return os.Rename(tmpName, n.path)
+}
+
+// IsRegistered reports whether name has an owner at all.
+func (n *NickServ) IsRegistered(name string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	_, ok := n.nicks[name]
+	return ok
+}
+
+// Owns reports whether fingerprint is one of name's registered owners.
+func (n *NickServ) Owns(name, fingerprint string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	rec, ok := n.nicks[name]
+	if !ok {
+		return false
+	}
+	for _, fp := range rec.Fingerprints {
+		if fp == fingerprint {
+			return true
+		}
+	}
+	return false
+}
+
+// Register binds name to fingerprint, failing if name is already owned
+// by someone else.
+func (n *NickServ) Register(name, fingerprint string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if rec, ok := n.nicks[name]; ok {
+		for _, fp := range rec.Fingerprints {
+			if fp == fingerprint {
+				return fmt.Errorf("%s is already registered to you", name)
+			}
+		}
+		return fmt.Errorf("%s is already registered", name)
+	}
+
+	n.nicks[name] = &nickRecord{Fingerprints: []string{fingerprint}}
+	return n.save()
+}
+
+// Transfer adds fingerprint as an additional owner of name, to be called
+// only after the caller has proven ownership (e.g. via /identify).
+func (n *NickServ) Transfer(name, fingerprint string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	rec, ok := n.nicks[name]
+	if !ok {
+		return fmt.Errorf("%s is not registered", name)
+	}
+	for _, fp := range rec.Fingerprints {
+		if fp == fingerprint {
+			return fmt.Errorf("%s is already an owner of %s", fingerprint, name)
+		}
+	}
+	rec.Fingerprints = append(rec.Fingerprints, fingerprint)
+	return n.save()
+}
+
+// Drop removes name's registration entirely.
+func (n *NickServ) Drop(name string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.nicks, name)
+	return n.save()
+}
+
+// nickservCommands are the chat commands exposed by the nickname
+// registry, merged into the main command table by the command parser.
+var nickservCommands = map[string]commandHandler{
+	"/register":      cmdRegister,
+	"/identify":      cmdIdentify,
+	"/nick-transfer": cmdNickTransfer,
+	"/nick-drop":     cmdNickDrop,
+}
+
+// /register <name> - bind the caller's current nick to their fingerprint.
+func cmdRegister(s *Server, client *Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /register <name>")
+	}
+	if args[0] != client.Name {
+		return fmt.Errorf("change your nick to %s first, then /register it", args[0])
+	}
+	if err := s.nickserv.Register(args[0], client.Fingerprint()); err != nil {
+		return err
+	}
+	client.Identified = true
+	client.Write(fmt.Sprintf("-> Registered %s to your key.", args[0]))
+	return nil
+}
+
+// /identify - claim the caller's current nick, if their fingerprint is a
+// registered owner of it. Server.Add/Server.Rename make the same check
+// themselves and mark the client identified whenever the fingerprint
+// already matches.
+func cmdIdentify(s *Server, client *Client, args []string) error {
+	if !s.nickserv.Owns(client.Name, client.Fingerprint()) {
+		return fmt.Errorf("you are not a registered owner of %s", client.Name)
+	}
+	client.Identified = true
+	client.Write(fmt.Sprintf("-> Identified as %s.", client.Name))
+	return nil
+}
+
+// /nick-transfer <name> <fingerprint> - add another key as an owner of a
+// nick the caller already owns.
+func cmdNickTransfer(s *Server, client *Client, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: /nick-transfer <name> <fingerprint>")
+	}
+	if !s.nickserv.Owns(args[0], client.Fingerprint()) {
+		return fmt.Errorf("you do not own %s", args[0])
+	}
+	if err := s.nickserv.Transfer(args[0], args[1]); err != nil {
+		return err
+	}
+	client.Write(fmt.Sprintf("-> Added %s as an owner of %s.", args[1], args[0]))
+	return nil
+}
+
+// /nick-drop <name> - release a registration the caller owns.
+func cmdNickDrop(s *Server, client *Client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: /nick-drop <name>")
+	}
+	if !s.nickserv.Owns(args[0], client.Fingerprint()) {
+		return fmt.Errorf("you do not own %s", args[0])
+	}
+	if err := s.nickserv.Drop(args[0]); err != nil {
+		return err
+	}
+	client.Write(fmt.Sprintf("-> Dropped registration for %s.", args[0]))
+	return nil
+}
+
+// displayName returns name prefixed with GuestPrefix when client hasn't
+// identified to a registered nick, so broadcasts make the distinction
+// visible.
+func displayName(client *Client) string {
+	if client.Identified {
+		return client.Name
+	}
+	return GuestPrefix + client.Name
+}
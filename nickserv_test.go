@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestNickServRegisterAndOwns(t *testing.T) {
+	n, err := NewNickServ("")
+	if err != nil {
+		t.Fatalf("NewNickServ: %v", err)
+	}
+
+	if n.IsRegistered("alice") {
+		t.Error("did not expect alice to be registered yet")
+	}
+
+	if err := n.Register("alice", "fp1"); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	if !n.IsRegistered("alice") {
+		t.Error("expected alice to be registered")
+	}
+	if !n.Owns("alice", "fp1") {
+		t.Error("expected fp1 to own alice")
+	}
+	if n.Owns("alice", "fp2") {
+		t.Error("did not expect fp2 to own alice")
+	}
+
+	if err := n.Register("alice", "fp2"); err == nil {
+		t.Error("expected re-registering alice under a different key to fail")
+	}
+}
+
+func TestNickServTransferAndDrop(t *testing.T) {
+	n, _ := NewNickServ("")
+	if err := n.Register("alice", "fp1"); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	if err := n.Transfer("alice", "fp2"); err != nil {
+		t.Fatalf("Transfer: %v", err)
+	}
+	if !n.Owns("alice", "fp2") {
+		t.Error("expected fp2 to own alice after transfer")
+	}
+	if !n.Owns("alice", "fp1") {
+		t.Error("expected fp1 to still own alice after transfer")
+	}
+
+	if err := n.Drop("alice"); err != nil {
+		t.Fatalf("Drop: %v", err)
+	}
+	if n.IsRegistered("alice") {
+		t.Error("did not expect alice to be registered after Drop")
+	}
+}
+
+func TestNickServTransferRequiresRegistration(t *testing.T) {
+	n, _ := NewNickServ("")
+	if err := n.Transfer("alice", "fp1"); err == nil {
+		t.Error("expected Transfer on an unregistered nick to fail")
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// DefaultRoom is joined automatically by every client on connect, and is
+// addressed by messages with no "#room:" prefix from a client that
+// hasn't /join'd anywhere else.
+const DefaultRoom = "#lobby"
+
+// RoomClients maps a client's name to the client, scoped to one room's
+// membership.
+type RoomClients map[string]*Client
+
+// Room is one addressable chat room: its own membership, history, topic,
+// per-room ops and mode flags. A Server manages a set of these instead of
+// a single global room.
+type Room struct {
+	name    string
+	lock    sync.Mutex
+	clients RoomClients
+	history *History
+	admins  map[string]struct{} // fingerprint lookup, room-scoped ops
+	topic   string
+	metrics *Metrics
+
+	InviteOnly bool
+	Moderated  bool
+	Private    bool // hidden from /list-rooms unless you're a member
+
+	invited map[string]struct{} // fingerprint lookup, only consulted when InviteOnly
+}
+
+// NewRoom creates an empty room named name (including the leading '#').
+// metrics may be nil, in which case room activity isn't instrumented.
+func NewRoom(name string, metrics *Metrics) *Room {
+	return &Room{
+		name:    name,
+		clients: RoomClients{},
+		history: NewHistory(HISTORY_LEN),
+		admins:  map[string]struct{}{},
+		invited: map[string]struct{}{},
+		metrics: metrics,
+	}
+}
+
+func (r *Room) Name() string {
+	return r.name
+}
+
+func (r *Room) Len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.clients)
+}
+
+// Broadcast delivers msg to every member of the room except, optionally,
+// one client, and records it in the room's own history.
+func (r *Room) Broadcast(msg string, except *Client) {
+	logger.Debugf("Room %s broadcast to %d: %s", r.name, r.Len(), msg)
+	if r.metrics != nil {
+		r.metrics.MessageBroadcast()
+	}
+
+	r.lock.Lock()
+	r.history.Add(msg)
+	clients := make([]*Client, 0, len(r.clients))
+	for _, client := range r.clients {
+		if except != nil && client == except {
+			continue
+		}
+		clients = append(clients, client)
+	}
+	r.lock.Unlock()
+
+	for _, client := range clients {
+		client.Write(msg)
+	}
+}
+
+// Add joins client to the room, rejecting the join if the room is
+// invite-only and the client hasn't been invited.
+func (r *Room) Add(client *Client) error {
+	r.lock.Lock()
+	if r.InviteOnly {
+		_, invited := r.invited[client.Fingerprint()]
+		_, isAdmin := r.admins[client.Fingerprint()]
+		if !invited && !isAdmin {
+			r.lock.Unlock()
+			return fmt.Errorf("%s is invite-only", r.name)
+		}
+	}
+
+	go func() {
+		client.WriteLines(r.history.Get(10))
+	}()
+
+	r.clients[client.Name] = client
+	num := len(r.clients)
+	r.lock.Unlock()
+
+	r.Broadcast(fmt.Sprintf("* %s joined %s. (Room total: %d)", displayName(client), r.name, num), client)
+	return nil
+}
+
+// Remove parts client from the room.
+func (r *Room) Remove(client *Client) {
+	r.lock.Lock()
+	_, present := r.clients[client.Name]
+	delete(r.clients, client.Name)
+	r.lock.Unlock()
+
+	if present {
+		r.Broadcast(fmt.Sprintf("* %s left %s.", displayName(client), r.name), nil)
+	}
+}
+
+// RenameMember updates the room's membership key after a client renames,
+// leaving their room membership otherwise untouched. No-op if the client
+// isn't a member.
+func (r *Room) RenameMember(oldName string, client *Client) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.clients[oldName]; !ok {
+		return
+	}
+	delete(r.clients, oldName)
+	r.clients[client.Name] = client
+}
+
+func (r *Room) List(prefix *string) []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	result := []string{}
+	for name := range r.clients {
+		if prefix != nil && !strings.HasPrefix(name, *prefix) {
+			continue
+		}
+		result = append(result, name)
+	}
+	return result
+}
+
+func (r *Room) Who(name string) *Client {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.clients[name]
+}
+
+func (r *Room) Topic() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.topic
+}
+
+func (r *Room) SetTopic(topic string) {
+	r.lock.Lock()
+	r.topic = topic
+	r.lock.Unlock()
+}
+
+func (r *Room) Op(fingerprint string) {
+	r.lock.Lock()
+	r.admins[fingerprint] = struct{}{}
+	r.lock.Unlock()
+}
+
+func (r *Room) IsOp(client *Client) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, ok := r.admins[client.Fingerprint()]
+	return ok
+}
+
+func (r *Room) Invite(fingerprint string) {
+	r.lock.Lock()
+	r.invited[fingerprint] = struct{}{}
+	r.lock.Unlock()
+}
+
+// roomModes maps the flag names accepted by /mode to the Room field they
+// control.
+var roomModes = map[string]func(*Room) *bool{
+	"invite-only": func(r *Room) *bool { return &r.InviteOnly },
+	"moderated":   func(r *Room) *bool { return &r.Moderated },
+	"private":     func(r *Room) *bool { return &r.Private },
+}
+
+// SetMode enables or disables one of the room's mode flags (see
+// roomModes), failing if flag isn't one of them.
+func (r *Room) SetMode(flag string, enabled bool) error {
+	field, ok := roomModes[flag]
+	if !ok {
+		return fmt.Errorf("unknown mode: %s", flag)
+	}
+	r.lock.Lock()
+	*field(r) = enabled
+	r.lock.Unlock()
+	return nil
+}
+
+// IsPrivate reports whether the room is hidden from /list-rooms for
+// non-members.
+func (r *Room) IsPrivate() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.Private
+}
+
+// IsModerated reports whether only ops may speak in the room.
+func (r *Room) IsModerated() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.Moderated
+}
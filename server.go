@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/md5"
 	"fmt"
+	"io"
 	"net"
 	"regexp"
 	"strings"
@@ -22,12 +23,20 @@ type Clients map[string]*Client
 type Server struct {
 	sshConfig *ssh.ServerConfig
 	done      chan struct{}
-	clients   Clients
+	clients   Clients // identity registry: name -> client, across all rooms
 	lock      sync.Mutex
 	count     int
-	history   *History
-	admins    map[string]struct{}   // fingerprint lookup
-	banned    map[string]*time.Time // fingerprint lookup
+	rooms     map[string]*Room
+	auth      *Auth
+	policy    ForwardingPolicy
+	nickserv  *NickServ
+	metrics   *Metrics
+	audit     *AuditLog
+
+	// RequireAgentForAdmin, when true, requires admins to pass a fresh
+	// agent.Sign challenge (see /prove) before privileged commands like
+	// /op, /ban or /kick will take effect.
+	RequireAgentForAdmin bool
 }
 
 func NewServer(privateKey []byte) (*Server, error) {
@@ -36,13 +45,17 @@ func NewServer(privateKey []byte) (*Server, error) {
 		return nil, err
 	}
 
+	nickserv, _ := NewNickServ("") // empty path: in-memory only until SetNickServFile is called
+	metrics := NewMetrics()
+
 	server := Server{
-		done:    make(chan struct{}),
-		clients: Clients{},
-		count:   0,
-		history: NewHistory(HISTORY_LEN),
-		admins:  map[string]struct{}{},
-		banned:  map[string]*time.Time{},
+		done:     make(chan struct{}),
+		clients:  Clients{},
+		count:    0,
+		rooms:    map[string]*Room{DefaultRoom: NewRoom(DefaultRoom, metrics)},
+		auth:     NewAuth(),
+		nickserv: nickserv,
+		metrics:  metrics,
 	}
 
 	config := ssh.ServerConfig{
@@ -50,9 +63,21 @@ func NewServer(privateKey []byte) (*Server, error) {
 		// Auth-related things should be constant-time to avoid timing attacks.
 		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 			fingerprint := Fingerprint(key)
-			if server.IsBanned(fingerprint) {
+			query := BanQuery{
+				Key:    fingerprint,
+				IP:     hostOnly(conn.RemoteAddr().String()),
+				Name:   conn.User(),
+				Client: string(conn.ClientVersion()),
+			}
+			if server.auth.IsBanned(query) {
+				server.metrics.BanHit()
+				server.auditLog(AuditEvent{Type: "auth_failed", Fingerprint: fingerprint, RemoteAddr: query.IP, Client: query.Client, Detail: "banned"})
 				return nil, fmt.Errorf("Banned.")
 			}
+			if !server.auth.IsAllowed(fingerprint) {
+				server.auditLog(AuditEvent{Type: "auth_failed", Fingerprint: fingerprint, RemoteAddr: query.IP, Client: query.Client, Detail: "not allowlisted"})
+				return nil, fmt.Errorf("Not on the allowlist.")
+			}
 			perm := &ssh.Permissions{Extensions: map[string]string{"fingerprint": fingerprint}}
 			return perm, nil
 		},
@@ -64,53 +89,211 @@ func NewServer(privateKey []byte) (*Server, error) {
 	return &server, nil
 }
 
+// SetAuthorizedKeysFile seeds the admin set and allowlist from an
+// authorized_keys-style file, to be called before Start.
+func (s *Server) SetAuthorizedKeysFile(path string) error {
+	return s.auth.LoadAuthorizedKeys(path)
+}
+
+// SetAuthFile switches the server's Auth state to be persisted as JSON at
+// path, loading any existing state immediately. Call before Start.
+func (s *Server) SetAuthFile(path string) error {
+	auth, err := NewFileAuth(path)
+	if err != nil {
+		return err
+	}
+	s.auth = auth
+	return nil
+}
+
+// SetNickServFile switches the server's nickname registry to be
+// persisted as JSON at path, loading any existing registrations
+// immediately. Call before Start.
+func (s *Server) SetNickServFile(path string) error {
+	nickserv, err := NewNickServ(path)
+	if err != nil {
+		return err
+	}
+	s.nickserv = nickserv
+	return nil
+}
+
+// ReloadNickServ re-reads the nickname registry from disk, for wiring up
+// to SIGHUP.
+func (s *Server) ReloadNickServ() error {
+	return s.nickserv.Load()
+}
+
+// SetAuditWriter enables the structured JSON audit log, writing one
+// event per line to w.
+func (s *Server) SetAuditWriter(w io.Writer) {
+	s.audit = NewAuditLog(w)
+}
+
+// auditLog records event if an audit sink has been configured; it's a
+// silent no-op otherwise.
+func (s *Server) auditLog(event AuditEvent) {
+	if s.audit != nil {
+		s.audit.Log(event)
+	}
+}
+
+// hostOnly strips the port from a net.Addr-formatted address, falling back
+// to the input unchanged if it isn't in host:port form.
+func hostOnly(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
 func (s *Server) Len() int {
 	return len(s.clients)
 }
 
-func (s *Server) Broadcast(msg string, except *Client) {
-	logger.Debugf("Broadcast to %d: %s", s.Len(), msg)
-	s.history.Add(msg)
-
-	for _, client := range s.clients {
-		if except != nil && client == except {
-			continue
+// BroadcastToClientRooms delivers msg to every room client is currently a
+// member of, for system notices (e.g. a timeout) that should reach
+// whichever rooms the client was actually present in.
+func (s *Server) BroadcastToClientRooms(client *Client, msg string) {
+	for _, name := range client.RoomNames() {
+		if room := s.room(name); room != nil {
+			room.Broadcast(msg, nil)
 		}
-		client.Msg <- msg
 	}
 }
 
 func (s *Server) Add(client *Client) {
-	go func() {
-		client.WriteLines(s.history.Get(10))
-		client.Write(fmt.Sprintf("-> Welcome to ssh-chat. Enter /help for more."))
-	}()
+	client.Write(fmt.Sprintf("-> Welcome to ssh-chat. Enter /help for more."))
 
 	s.lock.Lock()
 	s.count++
 
-	newName, err := s.proposeName(client.Name)
+	newName, err := s.proposeName(client.Name, client.Fingerprint())
 	if err != nil {
-		client.Msg <- fmt.Sprintf("-> Your name '%s' is not available, renamed to '%s'. Use /nick <name> to change it.", client.Name, newName)
+		client.Write(fmt.Sprintf("-> Your name '%s' is not available, renamed to '%s'. Use /nick <name> to change it.", client.Name, newName))
 	}
 
 	client.Rename(newName)
+	client.Identified = s.nickserv.Owns(newName, client.Fingerprint())
+	if client.Identified {
+		client.Write(fmt.Sprintf("-> Identified as %s.", newName))
+	}
 	s.clients[client.Name] = client
-	num := len(s.clients)
 	s.lock.Unlock()
 
-	s.Broadcast(fmt.Sprintf("* %s joined. (Total connected: %d)", client.Name, num), client)
+	s.metrics.ClientJoined(client.sessionID, client.Fingerprint())
+	s.auditLog(AuditEvent{Type: "join", Fingerprint: client.Fingerprint(), RemoteAddr: hostOnly(client.Conn.RemoteAddr().String()), Client: string(client.Conn.ClientVersion()), Detail: client.Name})
+
+	if err := s.JoinRoom(client, DefaultRoom); err != nil {
+		logger.Errorf("Failed to join %s to %s: %v", client.Name, DefaultRoom, err)
+	}
 }
 
 func (s *Server) Remove(client *Client) {
+	if client.mainTimeoutTimer != nil {
+		client.mainTimeoutTimer.Stop()
+	}
+	if client.idleTimer != nil {
+		client.idleTimer.Stop()
+	}
+
+	for _, name := range client.RoomNames() {
+		if room := s.room(name); room != nil {
+			room.Remove(client)
+		}
+	}
+	client.clearRooms()
+
 	s.lock.Lock()
 	delete(s.clients, client.Name)
 	s.lock.Unlock()
 
-	s.Broadcast(fmt.Sprintf("* %s left.", client.Name), nil)
+	duration := s.metrics.ClientLeft(client.sessionID)
+	s.auditLog(AuditEvent{Type: "part", Fingerprint: client.Fingerprint(), RemoteAddr: hostOnly(client.Conn.RemoteAddr().String()), Client: string(client.Conn.ClientVersion()), Detail: fmt.Sprintf("%s, session %s", client.Name, duration)})
+
+	close(client.quit)
+}
+
+// room looks up a room by name without creating it.
+func (s *Server) room(name string) *Room {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.rooms[name]
+}
+
+// JoinRoom joins client to the named room, creating the room if it
+// doesn't exist yet, and makes it the client's active room for
+// unprefixed messages.
+func (s *Server) JoinRoom(client *Client, name string) error {
+	s.lock.Lock()
+	room, ok := s.rooms[name]
+	if !ok {
+		room = NewRoom(name, s.metrics)
+		s.rooms[name] = room
+	}
+	s.lock.Unlock()
+
+	if err := room.Add(client); err != nil {
+		return err
+	}
+
+	client.roomsLock.Lock()
+	client.rooms[name] = struct{}{}
+	client.Room = name
+	client.roomsLock.Unlock()
+	return nil
 }
 
-func (s *Server) proposeName(name string) (string, error) {
+// PartRoom removes client from the named room. If it was their active
+// room, another room they're still a member of becomes active, falling
+// back to rejoining DefaultRoom if that was their only one.
+func (s *Server) PartRoom(client *Client, name string) error {
+	room := s.room(name)
+	if room == nil {
+		return fmt.Errorf("no such room: %s", name)
+	}
+
+	room.Remove(client)
+
+	client.roomsLock.Lock()
+	delete(client.rooms, name)
+	wasActive := client.Room == name
+	if wasActive {
+		client.Room = ""
+		for other := range client.rooms {
+			client.Room = other
+			break
+		}
+	}
+	stillHomeless := wasActive && client.Room == ""
+	client.roomsLock.Unlock()
+
+	if stillHomeless {
+		return s.JoinRoom(client, DefaultRoom)
+	}
+	return nil
+}
+
+// ListRooms lists every non-private room, plus, when client is non-nil,
+// every private room client is a member of.
+func (s *Server) ListRooms(client *Client) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result := []string{}
+	for name, room := range s.rooms {
+		if room.IsPrivate() {
+			if client == nil || !client.InRoom(name) {
+				continue
+			}
+		}
+		result = append(result, name)
+	}
+	return result
+}
+
+func (s *Server) proposeName(name, fingerprint string) (string, error) {
 	// Assumes caller holds lock.
 	var err error
 	name = RE_STRIP_NAME.ReplaceAllString(name, "")
@@ -125,6 +308,9 @@ func (s *Server) proposeName(name string) (string, error) {
 	if collision {
 		err = fmt.Errorf("%s is not available.", name)
 		name = fmt.Sprintf("Guest%d", s.count)
+	} else if s.nickserv.IsRegistered(name) && !s.nickserv.Owns(name, fingerprint) {
+		err = fmt.Errorf("%s is registered.", name)
+		name = fmt.Sprintf("Guest%d", s.count)
 	}
 
 	return name, err
@@ -133,9 +319,9 @@ func (s *Server) proposeName(name string) (string, error) {
 func (s *Server) Rename(client *Client, newName string) {
 	s.lock.Lock()
 
-	newName, err := s.proposeName(newName)
+	newName, err := s.proposeName(newName, client.Fingerprint())
 	if err != nil {
-		client.Msg <- fmt.Sprintf("-> %s", err)
+		client.Write(fmt.Sprintf("-> %s", err))
 		s.lock.Unlock()
 		return
 	}
@@ -144,71 +330,144 @@ func (s *Server) Rename(client *Client, newName string) {
 	delete(s.clients, client.Name)
 	oldName := client.Name
 	client.Rename(newName)
+	client.Identified = s.nickserv.Owns(newName, client.Fingerprint())
 	s.clients[client.Name] = client
 	s.lock.Unlock()
 
-	s.Broadcast(fmt.Sprintf("* %s is now known as %s.", oldName, newName), nil)
-}
-
-func (s *Server) List(prefix *string) []string {
-	r := []string{}
+	if client.Identified {
+		client.Write(fmt.Sprintf("-> Identified as %s.", newName))
+	}
+	s.auditLog(AuditEvent{Type: "rename", Fingerprint: client.Fingerprint(), RemoteAddr: hostOnly(client.Conn.RemoteAddr().String()), Client: string(client.Conn.ClientVersion()), Detail: fmt.Sprintf("%s -> %s", oldName, newName)})
 
-	for name, _ := range s.clients {
-		if prefix != nil && !strings.HasPrefix(name, *prefix) {
-			continue
+	for _, name := range client.RoomNames() {
+		if room := s.room(name); room != nil {
+			room.RenameMember(oldName, client)
+			room.Broadcast(fmt.Sprintf("* %s is now known as %s.", oldName, displayName(client)), nil)
 		}
-		r = append(r, name)
 	}
+}
+
+// List lists the members of room matching prefix, if given.
+func (s *Server) List(room string, prefix *string) []string {
+	r := s.room(room)
+	if r == nil {
+		return nil
+	}
+	return r.List(prefix)
+}
 
-	return r
+// Who looks up a client by name within room.
+func (s *Server) Who(room, name string) *Client {
+	r := s.room(room)
+	if r == nil {
+		return nil
+	}
+	return r.Who(name)
 }
 
-func (s *Server) Who(name string) *Client {
+// ClientByName looks up a connected client by name across the whole
+// server, regardless of which rooms they're in.
+func (s *Server) ClientByName(name string) *Client {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	return s.clients[name]
 }
 
 func (s *Server) Op(fingerprint string) {
 	logger.Infof("Adding admin: %s", fingerprint)
-	s.lock.Lock()
-	s.admins[fingerprint] = struct{}{}
-	s.lock.Unlock()
+	s.auth.Op(fingerprint)
+	s.auditLog(AuditEvent{Type: "op", Fingerprint: fingerprint})
+}
+
+// Deop removes fingerprint's admin status.
+func (s *Server) Deop(fingerprint string) {
+	logger.Infof("Removing admin: %s", fingerprint)
+	s.auth.Deop(fingerprint)
+	s.auditLog(AuditEvent{Type: "deop", Fingerprint: fingerprint})
 }
 
 func (s *Server) IsOp(client *Client) bool {
-	_, r := s.admins[client.Fingerprint()]
-	return r
+	return s.auth.IsOp(client.Fingerprint())
 }
 
 func (s *Server) IsBanned(fingerprint string) bool {
-	ban, hasBan := s.banned[fingerprint]
-	if !hasBan {
-		return false
-	}
-	if ban == nil {
-		return true
-	}
-	if ban.Before(time.Now()) {
-		s.Unban(fingerprint)
-		return false
-	}
-	return true
+	return s.auth.IsBanned(BanQuery{Key: fingerprint})
 }
 
 func (s *Server) Ban(fingerprint string, duration *time.Duration) {
+	s.auth.Ban(durationQuery(BanQuery{Key: fingerprint}, duration))
+	s.metrics.BanIssued()
+	s.auditLog(AuditEvent{Type: "ban", Fingerprint: fingerprint})
+}
+
+// BanIP bans every fingerprint connecting from remote IP addr.
+func (s *Server) BanIP(addr string, duration *time.Duration) {
+	s.auth.Ban(durationQuery(BanQuery{IP: addr}, duration))
+	s.metrics.BanIssued()
+	s.auditLog(AuditEvent{Type: "ban", RemoteAddr: addr})
+}
+
+// BanClient bans every connection whose SSH client version string contains
+// substr, e.g. to block a known-abusive bot.
+func (s *Server) BanClient(substr string, duration *time.Duration) {
+	s.auth.Ban(durationQuery(BanQuery{Client: substr}, duration))
+	s.metrics.BanIssued()
+	s.auditLog(AuditEvent{Type: "ban", Client: substr})
+}
+
+// BanName bans every connection whose requested username matches glob (a
+// filepath.Match pattern), e.g. to block a class of bot usernames.
+func (s *Server) BanName(glob string, duration *time.Duration) {
+	s.auth.Ban(durationQuery(BanQuery{Name: glob}, duration))
+	s.metrics.BanIssued()
+	s.auditLog(AuditEvent{Type: "ban", Detail: fmt.Sprintf("name glob: %s", glob)})
+}
+
+// durationQuery is a helper for Ban/BanIP/BanClient/BanName: it returns
+// query along with the expiry computed from duration (nil for forever),
+// as the arguments of a single auth.Ban call. It records nothing itself.
+func durationQuery(query BanQuery, duration *time.Duration) (BanQuery, *time.Time) {
 	var until *time.Time
-	s.lock.Lock()
 	if duration != nil {
 		when := time.Now().Add(*duration)
 		until = &when
 	}
-	s.banned[fingerprint] = until
-	s.lock.Unlock()
+	return query, until
 }
 
 func (s *Server) Unban(fingerprint string) {
-	s.lock.Lock()
-	delete(s.banned, fingerprint)
-	s.lock.Unlock()
+	s.auth.Unban(BanQuery{Key: fingerprint})
+	s.auditLog(AuditEvent{Type: "unban", Fingerprint: fingerprint})
+}
+
+// UnbanIP removes a ban previously recorded by BanIP.
+func (s *Server) UnbanIP(addr string) {
+	s.auth.Unban(BanQuery{IP: addr})
+	s.auditLog(AuditEvent{Type: "unban", RemoteAddr: addr})
+}
+
+// UnbanClient removes a ban previously recorded by BanClient.
+func (s *Server) UnbanClient(substr string) {
+	s.auth.Unban(BanQuery{Client: substr})
+	s.auditLog(AuditEvent{Type: "unban", Client: substr})
+}
+
+// UnbanName removes a ban previously recorded by BanName.
+func (s *Server) UnbanName(glob string) {
+	s.auth.Unban(BanQuery{Name: glob})
+	s.auditLog(AuditEvent{Type: "unban", Detail: fmt.Sprintf("name glob: %s", glob)})
+}
+
+// Allow adds fingerprint to the allowlist, so it may connect while the
+// allowlist is enabled.
+func (s *Server) Allow(fingerprint string) {
+	s.auth.Allow(fingerprint)
+}
+
+// Whitelist enables or disables the allowlist. While enabled, only
+// fingerprints added via Allow (or SetAuthorizedKeysFile) may connect.
+func (s *Server) Whitelist(enabled bool) {
+	s.auth.SetWhitelist(enabled)
 }
 
 func (s *Server) Start(laddr string) error {
@@ -231,21 +490,26 @@ func (s *Server) Start(laddr string) error {
 				return
 			}
 
+			s.metrics.ConnectionAccepted()
+
 			// Goroutineify to resume accepting sockets early.
 			go func() {
 				// From a standard TCP connection to an encrypted SSH connection
 				sshConn, channels, requests, err := ssh.NewServerConn(conn, s.sshConfig)
 				if err != nil {
+					s.metrics.HandshakeFailed()
 					logger.Errorf("Failed to handshake: %v", err)
 					return
 				}
 
 				logger.Infof("Connection #%d from: %s, %s, %s", s.count+1, sshConn.RemoteAddr(), sshConn.User(), sshConn.ClientVersion())
 
-				go ssh.DiscardRequests(requests)
+				go s.handleGlobalRequests(requests)
 
 				client := NewClient(s, sshConn)
-				go client.handleChannels(channels)
+				s.enforceDeadlines(conn, client)
+
+				go client.handleChannels(s.filterDirectTCPIP(channels, sshConn.Permissions.Extensions["fingerprint"]))
 			}()
 		}
 	}()